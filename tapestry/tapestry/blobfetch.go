@@ -0,0 +1,66 @@
+package tapestry
+
+import (
+	"context"
+	"fmt"
+	"net/rpc"
+)
+
+/*
+	BlobFetchRequest asks the receiving node for the blob it advertised under
+	Key.
+*/
+type BlobFetchRequest struct {
+	Key string
+}
+
+/*
+	BlobFetchReply carries the blob returned by a BlobFetchRequest.
+*/
+type BlobFetchReply struct {
+	Blob []byte
+}
+
+/*
+	fetchRemoteBlobContext fetches the blob advertised under key from replica,
+	plumbed with a context so that GetContext can give up on a single slow
+	replica without waiting for it to finish, rather than only being able to
+	skip to the next replica once the current one returns.
+
+	Mirrors sendPing's use of client.Go plus a select on call.Done, so a
+	canceled ctx aborts the wait on this particular RPC rather than leaving a
+	goroutine blocked on it.
+*/
+func fetchRemoteBlobContext(ctx context.Context, replica Node, key string) (*[]byte, error) {
+	client, err := rpc.Dial("tcp", replica.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Error dialing %v to fetch %v: %v", replica, key, err)
+	}
+	defer client.Close()
+
+	var reply BlobFetchReply
+	req := BlobFetchRequest{Key: key}
+	call := client.Go("TapestryRPCServer.FetchBlob", req, &reply, nil)
+
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return nil, call.Error
+		}
+		return &reply.Blob, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+/*
+	RPC handler: returns the blob the local node has stored for req.Key.
+*/
+func (server *TapestryRPCServer) FetchBlob(req BlobFetchRequest, reply *BlobFetchReply) error {
+	blob, exists := server.tapestry.blobstore.Get(req.Key)
+	if !exists {
+		return fmt.Errorf("No blob stored locally for key %v", req.Key)
+	}
+	reply.Blob = blob
+	return nil
+}
@@ -0,0 +1,224 @@
+package tapestry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// DEFAULT_BOND_WINDOW is how long a successful pong keeps a peer considered
+// bonded before another ping-back is required.
+const DEFAULT_BOND_WINDOW = 10 * time.Minute
+
+// A Nonce accompanies a Ping and must be echoed back in the matching Pong so
+// that a Pong can't be forged or replayed from an unrelated exchange.
+type Nonce uint64
+
+/*
+	Generates a Nonce from a cryptographically secure random source, so an
+	off-path attacker can't precompute a valid Pong for a ping it hasn't seen.
+*/
+func newNonce() Nonce {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("Unable to generate a random nonce: %v", err))
+	}
+	return Nonce(binary.BigEndian.Uint64(buf[:]))
+}
+
+/*
+	PingRequest is sent to a remote node to prove that our local node is
+	reachable at the address it claims, and to ask the remote node to prove
+	the same back to us.
+*/
+type PingRequest struct {
+	From  Node
+	Nonce Nonce
+}
+
+/*
+	PongMessage is the reply to a PingRequest. Nonce must match the nonce of
+	the request it answers.
+*/
+type PongMessage struct {
+	From  Node
+	Nonce Nonce
+}
+
+/*
+	bondRecord tracks the endpoint-proof state for a single remote node:
+	the last time it pinged us, the last time it proved itself by returning
+	a matching pong, and how many consecutive times it has failed to do so.
+*/
+type bondRecord struct {
+	lastPingReceived time.Time
+	lastPongReceived time.Time
+	findFails        int
+}
+
+/*
+	bondTable is a small in-memory database of bondRecords keyed by node ID.
+	It backs the endpoint-proof check that gates insertion into the routing
+	table: a peer is only "bonded" once we've pinged it and received a pong
+	with a matching nonce within the configured window.
+*/
+type bondTable struct {
+	mutex sync.Mutex
+	peers map[ID]*bondRecord
+}
+
+func newBondTable() *bondTable {
+	return &bondTable{
+		peers: make(map[ID]*bondRecord),
+	}
+}
+
+func (table *bondTable) record(id ID) *bondRecord {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	record, exists := table.peers[id]
+	if !exists {
+		record = new(bondRecord)
+		table.peers[id] = record
+	}
+	return record
+}
+
+/*
+	Reports whether id has proven itself with a pong within window.
+*/
+func (table *bondTable) bonded(id ID, window time.Duration) bool {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	record, exists := table.peers[id]
+	if !exists || record.lastPongReceived.IsZero() {
+		return false
+	}
+	return time.Since(record.lastPongReceived) < window
+}
+
+func (table *bondTable) markPingReceived(id ID) {
+	table.record(id).lastPingReceived = time.Now()
+}
+
+func (table *bondTable) markPongReceived(id ID) {
+	record := table.record(id)
+	record.lastPongReceived = time.Now()
+	record.findFails = 0
+}
+
+func (table *bondTable) markFindFailed(id ID) {
+	table.record(id).findFails++
+}
+
+/*
+	Bonds with n if it isn't already bonded within the configured window:
+	sends it a Ping and waits for a Pong carrying the same nonce. Returns
+	true once n is bonded, whether that was established just now or earlier.
+*/
+func (tapestry *Tapestry) bond(n Node) bool {
+	return tapestry.bondContext(context.Background(), n)
+}
+
+/*
+	bondContext is bond, plumbed with a context so that a caller waiting on a
+	slow or unreachable peer can give up without leaking the in-flight RPC.
+*/
+func (tapestry *Tapestry) bondContext(ctx context.Context, n Node) bool {
+	if tapestry.peers.bonded(n.Id, tapestry.bondWindow) {
+		return true
+	}
+
+	nonce := newNonce()
+	pong, err := tapestry.sendPing(ctx, n, nonce)
+	if err != nil || pong.Nonce != nonce || pong.From.Id != n.Id {
+		tapestry.peers.markFindFailed(n.Id)
+		return false
+	}
+
+	tapestry.peers.markPongReceived(n.Id)
+	tapestry.recordPeer(n)
+	tapestry.ObserveNode(n)
+	return true
+}
+
+/*
+	Reports whether n may be inserted into the routing table: GetNextHop,
+	FindRoot, and Publish handlers should consult this before calling
+	AddRoute/AddBackpointer on a node observed in an incoming request, so
+	that an unverified peer is still answered but never added.
+*/
+func (tapestry *Tapestry) shouldAddRoute(n Node) bool {
+	return tapestry.peers.bonded(n.Id, tapestry.bondWindow)
+}
+
+/*
+	ObserveNode is the entry point for considering n for routing table
+	insertion once it's been bonded: it consults shouldAddRoute before
+	offering n as a replacement candidate for its slot, so an address that
+	hasn't proven itself at its claimed ID is never queued for insertion.
+*/
+func (tapestry *Tapestry) ObserveNode(n Node) {
+	if !tapestry.shouldAddRoute(n) {
+		return
+	}
+	tapestry.local.noteReplacementCandidate(n)
+}
+
+/*
+	Sends a Ping to n over RPC and returns its Pong. Aborts and returns ctx's
+	error as soon as ctx is canceled or its deadline passes, even if the
+	underlying net/rpc call is still in flight.
+*/
+func (tapestry *Tapestry) sendPing(ctx context.Context, n Node, nonce Nonce) (*PongMessage, error) {
+	client, err := rpc.Dial("tcp", n.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Error dialing %v for ping: %v", n, err)
+	}
+	defer client.Close()
+
+	var pong PongMessage
+	req := PingRequest{From: tapestry.local.node, Nonce: nonce}
+	call := client.Go("TapestryRPCServer.Ping", req, &pong, nil)
+
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return nil, call.Error
+		}
+		return &pong, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+/*
+	RPC handler: answers a Ping from a remote node, proving that this node
+	is reachable at the address it claims by echoing the nonce back.
+*/
+func (server *TapestryRPCServer) Ping(req PingRequest, reply *PongMessage) error {
+	server.tapestry.peers.markPingReceived(req.From.Id)
+
+	reply.From = server.tapestry.local.node
+	reply.Nonce = req.Nonce
+	return nil
+}
+
+/*
+	pingNode reports whether n is currently reachable, without requiring a
+	full bond. Used by the routing table revalidator, which only cares about
+	liveness rather than endpoint-proof.
+*/
+func (tapestry *Tapestry) pingNode(n Node) bool {
+	ctx, cancel := WithTimeout(RETRIES * time.Second)
+	defer cancel()
+
+	_, err := tapestry.sendPing(ctx, n, newNonce())
+	return err == nil
+}
@@ -0,0 +1,36 @@
+package tapestry
+
+import "time"
+
+/*
+	Config collects the knobs a caller of Start may want to override. Any
+	field left at its zero value falls back to the package default.
+*/
+type Config struct {
+	RevalidateInterval time.Duration // how often the routing table revalidator checks a random slot
+	BondWindow         time.Duration // how long a successful ping-back pong keeps a peer bonded
+	NodeDBPath         string        // where the persistent node database is stored; defaults to a path derived from the node's ID
+	RoutingNetCap      int           // how many routing table entries may share a /24 or /64 bucket
+	RoutingLevelNetCap int           // how many entries from a single bucket are allowed within one routing table level
+}
+
+/*
+	Fills in the package defaults for any field left at its zero value.
+	NodeDBPath is left untouched here since its default depends on the node's
+	ID, which isn't known yet; start() resolves it via defaultNodeDBPath.
+*/
+func (config Config) withDefaults() Config {
+	if config.RevalidateInterval <= 0 {
+		config.RevalidateInterval = DEFAULT_REVALIDATE_INTERVAL
+	}
+	if config.BondWindow <= 0 {
+		config.BondWindow = DEFAULT_BOND_WINDOW
+	}
+	if config.RoutingNetCap <= 0 {
+		config.RoutingNetCap = DEFAULT_NET_CAP
+	}
+	if config.RoutingLevelNetCap <= 0 {
+		config.RoutingLevelNetCap = DEFAULT_NET_CAP_PER_LEVEL
+	}
+	return config
+}
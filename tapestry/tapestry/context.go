@@ -0,0 +1,58 @@
+package tapestry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+type contextKey string
+
+const requestIDKey contextKey = "tapestry-request-id"
+
+/*
+	Attaches a request ID to ctx so that every log line emitted while
+	handling a single Store/Get/Lookup, across however many hops it takes,
+	can be tied back together.
+*/
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+/*
+	Returns the request ID carried on ctx, if one was attached.
+*/
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey).(string)
+	return id, ok
+}
+
+/*
+	Generates a short, probably-unique ID for tagging a new request.
+*/
+func NewRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+/*
+	Returns ctx unchanged if it already carries a request ID, otherwise
+	attaches a freshly generated one. Used at the entry points of the public
+	API so every call is traceable even if the caller didn't set one.
+*/
+func withRequestID(ctx context.Context) context.Context {
+	if _, ok := RequestIDFromContext(ctx); ok {
+		return ctx
+	}
+	return WithRequestID(ctx, NewRequestID())
+}
+
+/*
+	WithTimeout is a convenience wrapper around context.WithTimeout, for
+	callers that don't otherwise need their own context.
+*/
+func WithTimeout(d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), d)
+}
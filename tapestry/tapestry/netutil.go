@@ -0,0 +1,178 @@
+package tapestry
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// DEFAULT_NET_CAP is how many routing table entries (or replica
+// advertisements for a single key) may share the same /24 (IPv4) or /64
+// (IPv6) bucket before further insertions from that bucket are rejected.
+const DEFAULT_NET_CAP = 10
+
+// DEFAULT_NET_CAP_PER_LEVEL further restricts a single /24 or /64 to this
+// many entries within one routing table level, on top of the table-wide cap.
+const DEFAULT_NET_CAP_PER_LEVEL = 2
+
+/*
+	Classifies addr (a "host:port" string) into the /24 bucket of its IPv4
+	address or the /64 bucket of its IPv6 address. Used to detect a single
+	operator stuffing many routing table slots or replica advertisements from
+	addresses that are cheap to acquire but topologically identical.
+*/
+func NetBucket(addr string) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// addr is a hostname (e.g. "nodeA:1234" from os.Hostname()) rather
+		// than a literal IP; resolve it so the bucket still reflects the
+		// node's real subnet instead of being skipped entirely.
+		resolved, err := net.LookupHost(host)
+		if err != nil || len(resolved) == 0 {
+			return "", fmt.Errorf("Unable to resolve host %v from address %v", host, addr)
+		}
+		ip = net.ParseIP(resolved[0])
+		if ip == nil {
+			return "", fmt.Errorf("Unable to parse resolved IP %v for host %v", resolved[0], host)
+		}
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		mask := net.CIDRMask(24, 32)
+		return v4.Mask(mask).String() + "/24", nil
+	}
+
+	mask := net.CIDRMask(64, 128)
+	return ip.Mask(mask).String() + "/64", nil
+}
+
+/*
+	DistinctNetSet counts how many entries come from each address bucket (see
+	NetBucket), so that a caller can cap how many entries from a single
+	subnet it's willing to hold. Safe for concurrent use.
+*/
+type DistinctNetSet struct {
+	mutex  sync.Mutex
+	cap    int
+	counts map[string]int
+}
+
+/*
+	Creates a DistinctNetSet that rejects a bucket's (cap+1)'th entry.
+*/
+func NewDistinctNetSet(cap int) *DistinctNetSet {
+	return &DistinctNetSet{
+		cap:    cap,
+		counts: make(map[string]int),
+	}
+}
+
+/*
+	Reports whether addr could be added without pushing its bucket over the
+	cap, without actually recording it.
+*/
+func (set *DistinctNetSet) Allows(addr string) bool {
+	bucket, err := NetBucket(addr)
+	if err != nil {
+		return true
+	}
+
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	return set.counts[bucket] < set.cap
+}
+
+/*
+	Records addr as occupying a slot in its bucket. Returns false (and does
+	not record) if the bucket is already at capacity.
+*/
+func (set *DistinctNetSet) Add(addr string) bool {
+	bucket, err := NetBucket(addr)
+	if err != nil {
+		return true
+	}
+
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	if set.counts[bucket] >= set.cap {
+		return false
+	}
+	set.counts[bucket]++
+	return true
+}
+
+/*
+	Releases addr's slot in its bucket.
+*/
+func (set *DistinctNetSet) Remove(addr string) {
+	bucket, err := NetBucket(addr)
+	if err != nil {
+		return
+	}
+
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	if set.counts[bucket] > 0 {
+		set.counts[bucket]--
+		if set.counts[bucket] == 0 {
+			delete(set.counts, bucket)
+		}
+	}
+}
+
+/*
+	levelNetSet returns the DistinctNetSet tracking subnet diversity within a
+	single routing table level, creating it on first use.
+*/
+func (tapestry *Tapestry) levelNetSet(level int) *DistinctNetSet {
+	tapestry.routingLevelNetsMutex.Lock()
+	defer tapestry.routingLevelNetsMutex.Unlock()
+
+	set, exists := tapestry.routingLevelNets[level]
+	if !exists {
+		set = NewDistinctNetSet(tapestry.routingLevelNetCap)
+		tapestry.routingLevelNets[level] = set
+	}
+	return set
+}
+
+/*
+	allowsNet reports whether addr could be admitted into routing table level
+	without pushing either the table-wide or the per-level bucket over cap.
+*/
+func (tapestry *Tapestry) allowsNet(level int, addr string) bool {
+	return tapestry.routingNets.Allows(addr) && tapestry.levelNetSet(level).Allows(addr)
+}
+
+/*
+	addNet records addr as occupying a slot at level, in both the table-wide
+	and per-level bucket counts. Returns false, leaving neither count changed,
+	if either cap would be exceeded.
+*/
+func (tapestry *Tapestry) addNet(level int, addr string) bool {
+	if !tapestry.routingNets.Add(addr) {
+		return false
+	}
+	if !tapestry.levelNetSet(level).Add(addr) {
+		tapestry.routingNets.Remove(addr)
+		return false
+	}
+	return true
+}
+
+/*
+	removeNet releases addr's slot at level in both the table-wide and
+	per-level bucket counts.
+*/
+func (tapestry *Tapestry) removeNet(level int, addr string) {
+	tapestry.routingNets.Remove(addr)
+	tapestry.levelNetSet(level).Remove(addr)
+}
@@ -0,0 +1,222 @@
+package tapestry
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DEFAULT_NODE_DB_PATH_FORMAT derives a node's node database path when none
+// is configured. It's keyed by node ID rather than a single fixed name so
+// that multiple nodes sharing a process or host don't clobber each other's
+// records.
+const DEFAULT_NODE_DB_PATH_FORMAT = "tapestry_nodedb_%s.json"
+
+/*
+	defaultNodeDBPath returns the default node database path for a node with
+	the given ID.
+*/
+func defaultNodeDBPath(id ID) string {
+	return fmt.Sprintf(DEFAULT_NODE_DB_PATH_FORMAT, id.String())
+}
+
+// SEED_MIN_AGE is the minimum time a peer must have been observed for before
+// it's trusted as a bootstrap seed; this keeps a restart from seeding itself
+// off a peer that only just joined and may vanish just as quickly.
+const SEED_MIN_AGE = 5 * time.Minute
+
+// NODE_EXPIRY is how long a peer may go unseen before it's dropped from the
+// node database.
+const NODE_EXPIRY = 24 * time.Hour
+
+// NODE_DB_CLEANUP_INTERVAL is how often expired entries are swept out.
+const NODE_DB_CLEANUP_INTERVAL = 1 * time.Hour
+
+/*
+	A NodeRecord is everything the node database remembers about a peer.
+*/
+type NodeRecord struct {
+	Node             Node
+	FirstSeen        time.Time
+	LastPongReceived time.Time
+	FindFails        int
+}
+
+/*
+	NodeDB is the interface the node database is kept behind, so the default
+	JSON-file implementation can be swapped for LevelDB, bbolt, or anything
+	else without touching the rest of Tapestry.
+*/
+type NodeDB interface {
+	Put(record NodeRecord) error
+	Get(id ID) (NodeRecord, bool)
+	All() []NodeRecord
+	Delete(id ID)
+	Close() error
+}
+
+/*
+	jsonNodeDB is the default NodeDB: a single JSON file holding every known
+	record, rewritten in full on each mutation. Good enough for the number of
+	peers a single tapestry node deals with; not meant for huge tables.
+*/
+type jsonNodeDB struct {
+	mutex   sync.Mutex
+	path    string
+	records map[ID]NodeRecord
+}
+
+/*
+	Opens the node database at path, loading any existing records. If path
+	doesn't exist yet, starts with an empty database.
+*/
+func NewJSONNodeDB(path string) (NodeDB, error) {
+	db := &jsonNodeDB{
+		path:    path,
+		records: make(map[ID]NodeRecord),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []NodeRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		db.records[record.Node.Id] = record
+	}
+
+	return db, nil
+}
+
+func (db *jsonNodeDB) Put(record NodeRecord) error {
+	db.mutex.Lock()
+	db.records[record.Node.Id] = record
+	db.mutex.Unlock()
+
+	return db.flush()
+}
+
+func (db *jsonNodeDB) Get(id ID) (record NodeRecord, exists bool) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	record, exists = db.records[id]
+	return
+}
+
+func (db *jsonNodeDB) All() (records []NodeRecord) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, record := range db.records {
+		records = append(records, record)
+	}
+	return
+}
+
+func (db *jsonNodeDB) Delete(id ID) {
+	db.mutex.Lock()
+	delete(db.records, id)
+	db.mutex.Unlock()
+
+	db.flush()
+}
+
+func (db *jsonNodeDB) Close() error {
+	return nil
+}
+
+func (db *jsonNodeDB) flush() error {
+	db.mutex.Lock()
+	records := make([]NodeRecord, 0, len(db.records))
+	for _, record := range db.records {
+		records = append(records, record)
+	}
+	db.mutex.Unlock()
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(db.path, data, 0644)
+}
+
+/*
+	Updates the node database entry for n, creating it with FirstSeen set to
+	now if this is the first time n has been recorded. Called whenever a bond
+	succeeds and whenever a node joins through us.
+*/
+func (tapestry *Tapestry) recordPeer(n Node) {
+	if tapestry.nodeDB == nil {
+		return
+	}
+
+	record, exists := tapestry.nodeDB.Get(n.Id)
+	if !exists {
+		record = NodeRecord{Node: n, FirstSeen: time.Now()}
+	}
+	record.Node = n
+	record.LastPongReceived = time.Now()
+	record.FindFails = 0
+
+	tapestry.nodeDB.Put(record)
+}
+
+/*
+	Seeds returns bootstrap candidates from the node database: peers that
+	have been known for at least SEED_MIN_AGE, so a node that only just
+	appeared isn't relied on to still be around after a restart.
+*/
+func (tapestry *Tapestry) Seeds() (seeds []Node) {
+	if tapestry.nodeDB == nil {
+		return nil
+	}
+
+	for _, record := range tapestry.nodeDB.All() {
+		if time.Since(record.FirstSeen) >= SEED_MIN_AGE {
+			seeds = append(seeds, record.Node)
+		}
+	}
+	return
+}
+
+/*
+	Starts the background sweep that expires node database entries that
+	haven't been seen in NODE_EXPIRY. Stops when tapestry.nodeDBCleanupDone is
+	closed.
+*/
+func (tapestry *Tapestry) startNodeDBCleanup() {
+	ticker := time.NewTicker(NODE_DB_CLEANUP_INTERVAL)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				tapestry.expireStaleNodes()
+			case <-tapestry.nodeDBCleanupDone:
+				return
+			}
+		}
+	}()
+}
+
+func (tapestry *Tapestry) expireStaleNodes() {
+	if tapestry.nodeDB == nil {
+		return
+	}
+
+	for _, record := range tapestry.nodeDB.All() {
+		if time.Since(record.LastPongReceived) >= NODE_EXPIRY {
+			tapestry.nodeDB.Delete(record.Node.Id)
+		}
+	}
+}
@@ -13,8 +13,10 @@ import (
 	Objects time out after some amount of time if the advertising node is not heard from
 */
 type ObjectStore struct {
-	mutex sync.Mutex                      // to manage concurrent access to the object store
-	data  map[string]map[Node]*time.Timer // multimap: stores multiple nodes per key, and each node has a timeout
+	mutex  sync.Mutex                      // to manage concurrent access to the object store
+	data   map[string]map[Node]*time.Timer // multimap: stores multiple nodes per key, and each node has a timeout
+	nets   map[string]*DistinctNetSet      // per-key count of replicas per /24 or /64 bucket, so one subnet can't monopolize a key
+	netCap int                             // how many replicas for a single key may share a bucket
 }
 
 /*
@@ -23,6 +25,8 @@ type ObjectStore struct {
 func NewObjectStore() *ObjectStore {
 	m := new(ObjectStore)
 	m.data = make(map[string]map[Node]*time.Timer)
+	m.nets = make(map[string]*DistinctNetSet)
+	m.netCap = DEFAULT_NET_CAP
 	return m
 }
 
@@ -41,6 +45,17 @@ func (store *ObjectStore) Register(key string, replica Node, timeout time.Durati
 	// Add the value to the value set
 	timer, exists := store.data[key][replica]
 	if !exists {
+		// Reject a new replica if its subnet already monopolizes this key
+		nets, netsExist := store.nets[key]
+		if !netsExist {
+			nets = NewDistinctNetSet(store.netCap)
+			store.nets[key] = nets
+		}
+		if !nets.Add(replica.Address) {
+			store.mutex.Unlock()
+			return false
+		}
+
 		store.data[key][replica] = store.newTimeout(key, replica, timeout)
 	} else {
 		timer.Reset(TIMEOUT)
@@ -62,7 +77,19 @@ func (store *ObjectStore) RegisterAll(replicamap map[string][]Node, timeout time
 		if !exists {
 			store.data[key] = make(map[Node]*time.Timer)
 		}
+
+		nets, netsExist := store.nets[key]
+		if !netsExist {
+			nets = NewDistinctNetSet(store.netCap)
+			store.nets[key] = nets
+		}
+
 		for _, replica := range replicas {
+			// Skip a replica whose subnet already monopolizes this key,
+			// same as Register
+			if _, exists := store.data[key][replica]; !exists && !nets.Add(replica.Address) {
+				continue
+			}
 			store.data[key][replica] = store.newTimeout(key, replica, timeout)
 		}
 	}
@@ -78,6 +105,11 @@ func (store *ObjectStore) Unregister(key string, replica Node) bool {
 
 	_, existed := store.data[key][replica]
 	delete(store.data[key], replica)
+	if existed {
+		if nets, exists := store.nets[key]; exists {
+			nets.Remove(replica.Address)
+		}
+	}
 
 	store.mutex.Unlock()
 
@@ -92,6 +124,7 @@ func (store *ObjectStore) UnregisterAll(key string) (replicas []Node) {
 
 	replicas = slice(store.data[key])
 	delete(store.data, key)
+	delete(store.nets, key)
 
 	store.mutex.Unlock()
 
@@ -128,6 +161,7 @@ func (store *ObjectStore) GetTransferRegistrations(local Node, remote Node) map[
 
 	for key, _ := range transfer {
 		delete(store.data, key)
+		delete(store.nets, key)
 	}
 
 	store.mutex.Unlock()
@@ -148,6 +182,9 @@ func (store *ObjectStore) newTimeout(key string, replica Node, timeout time.Dura
 		if exists {
 			timer.Stop()
 			delete(store.data[key], replica)
+			if nets, exists := store.nets[key]; exists {
+				nets.Remove(replica.Address)
+			}
 		}
 
 		store.mutex.Unlock()
@@ -0,0 +1,238 @@
+package tapestry
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DEFAULT_REVALIDATE_INTERVAL is how often a node revalidates a random slot
+// of its routing table when no explicit interval is configured.
+const DEFAULT_REVALIDATE_INTERVAL = 5 * time.Second
+
+// REPLACEMENT_CACHE_SIZE caps how many candidates are remembered per slot in
+// case the slot's primary occupant turns out to be dead.
+const REPLACEMENT_CACHE_SIZE = SLOTSIZE * 2
+
+/*
+	A replacementKey identifies a single (level, column) slot of the routing
+	table, i.e. the same address a candidate node would occupy if inserted.
+*/
+type replacementKey struct {
+	level int
+	col   int
+}
+
+/*
+	replacementCache remembers, per routing table slot, a capped FIFO of nodes
+	that were observed as candidates for that slot but weren't inserted
+	because the slot was already full. When a slot's occupant is evicted by
+	the revalidator, the front of its replacement list is promoted instead of
+	waiting for another node to join at exactly that slot.
+*/
+type replacementCache struct {
+	mutex sync.Mutex
+	lists map[replacementKey][]Node
+}
+
+func newReplacementCache() *replacementCache {
+	return &replacementCache{
+		lists: make(map[replacementKey][]Node),
+	}
+}
+
+/*
+	Remembers candidate as a replacement for the given slot. Drops the oldest
+	entry once the slot's list reaches REPLACEMENT_CACHE_SIZE, and is a no-op
+	if the candidate is already present.
+*/
+func (cache *replacementCache) offer(level, col int, candidate Node) {
+	key := replacementKey{level, col}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	list := cache.lists[key]
+	for _, n := range list {
+		if n == candidate {
+			return
+		}
+	}
+
+	list = append(list, candidate)
+	if len(list) > REPLACEMENT_CACHE_SIZE {
+		list = list[len(list)-REPLACEMENT_CACHE_SIZE:]
+	}
+	cache.lists[key] = list
+}
+
+/*
+	Pops the oldest remaining candidate for the given slot, if any.
+*/
+func (cache *replacementCache) take(level, col int) (Node, bool) {
+	key := replacementKey{level, col}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	list := cache.lists[key]
+	if len(list) == 0 {
+		return Node{}, false
+	}
+
+	candidate := list[0]
+	cache.lists[key] = list[1:]
+	return candidate, true
+}
+
+/*
+	Starts the background revalidator, which periodically pings the worst
+	entry of a random routing table slot and either promotes it or evicts it
+	in favour of a replacement candidate. Returns immediately; the goroutine
+	stops when tapestry.revalidateDone is closed.
+*/
+func (tapestry *Tapestry) startRevalidator() {
+	interval := tapestry.revalidateInterval
+	if interval <= 0 {
+		interval = DEFAULT_REVALIDATE_INTERVAL
+	}
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				tapestry.local.revalidateRandomSlot()
+			case <-tapestry.revalidateDone:
+				return
+			}
+		}
+	}()
+}
+
+/*
+	Picks a random (level, column) slot of the local routing table, pings its
+	last entry, and either moves it to the front of the slot on success or
+	evicts it and promotes a replacement candidate on failure.
+*/
+func (local *TapestryNode) revalidateRandomSlot() {
+	level := rand.Intn(DIGITS)
+	col := rand.Intn(BASE)
+
+	occupants := local.table.Slot(level, col)
+	if len(occupants) == 0 {
+		return
+	}
+	last := occupants[len(occupants)-1]
+
+	if local.tapestry.pingNode(last) {
+		local.table.Touch(level, col, last)
+		return
+	}
+
+	local.table.Remove(level, col, last)
+	local.tapestry.removeNet(level, last.Address)
+	Debug.Printf("Revalidation evicted dead node %v from slot (%v, %v)\n", last, level, col)
+
+	for {
+		replacement, ok := local.tapestry.replacements.take(level, col)
+		if !ok {
+			return
+		}
+		if !local.tapestry.shouldAddRoute(replacement) {
+			// Bonded nowhere within the window since it was offered; skip it.
+			continue
+		}
+		if local.tapestry.addNet(level, replacement.Address) {
+			local.table.Add(replacement)
+			return
+		}
+		// Replacement's subnet (table-wide or within this level) is already
+		// at capacity; try the next one.
+	}
+}
+
+/*
+	Remembers candidate as a replacement for whichever slot it would have
+	occupied, unless its subnet is already at capacity for that level.
+	Reached through ObserveNode after every successful bond; whether the slot
+	is already full is not checked.
+*/
+func (local *TapestryNode) noteReplacementCandidate(candidate Node) {
+	level, col := local.table.SlotFor(candidate.Id)
+	if !local.tapestry.allowsNet(level, candidate.Address) {
+		return
+	}
+	local.tapestry.replacements.offer(level, col, candidate)
+}
+
+/*
+	Slot returns the occupants of routing table row level, column col, ordered
+	from most-recently-touched to least. Safe for concurrent use.
+*/
+func (table *RoutingTable) Slot(level, col int) []Node {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	slot := table.rows[level][col]
+	occupants := make([]Node, len(slot))
+	copy(occupants, slot)
+	return occupants
+}
+
+/*
+	Touch moves n to the front of its slot, marking it as the most recently
+	confirmed-live occupant. No-op if n isn't actually in the slot.
+*/
+func (table *RoutingTable) Touch(level, col int, n Node) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	slot := table.rows[level][col]
+	for i, occupant := range slot {
+		if occupant == n {
+			copy(slot[1:i+1], slot[:i])
+			slot[0] = n
+			return
+		}
+	}
+}
+
+/*
+	Remove drops n from routing table row level, column col. No-op if n isn't
+	actually in the slot.
+*/
+func (table *RoutingTable) Remove(level, col int, n Node) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	slot := table.rows[level][col]
+	for i, occupant := range slot {
+		if occupant == n {
+			table.rows[level][col] = append(slot[:i], slot[i+1:]...)
+			return
+		}
+	}
+}
+
+/*
+	SlotFor returns the (level, column) of the routing table slot id would
+	occupy: level is the length of id's shared hex prefix with the local ID,
+	and col is id's digit at that level.
+*/
+func (table *RoutingTable) SlotFor(id ID) (level, col int) {
+	local := table.localId.String()
+	target := id.String()
+
+	for level = 0; level < DIGITS; level++ {
+		if local[level] != target[level] {
+			break
+		}
+	}
+	col = int(target[level] - '0')
+	if col > 9 {
+		col = int(target[level]-'a') + 10
+	}
+	return level, col
+}
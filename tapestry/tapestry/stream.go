@@ -0,0 +1,188 @@
+package tapestry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"tapestry/tapestry/stream"
+)
+
+/*
+	Listener accepts connection-oriented streams dialed by Tapestry ID rather
+	than address, yielding net.Conns whose RemoteAddr reports ID@host:port.
+*/
+type Listener struct {
+	inner *stream.Listener
+}
+
+func (l *Listener) Addr() net.Addr { return l.inner.Addr() }
+func (l *Listener) Close() error   { return l.inner.Close() }
+
+/*
+	Accept waits for and returns the next verified incoming stream.
+*/
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.inner.Accept()
+}
+
+/*
+	Listen returns a stream listener multiplexed onto the same port as the
+	RPC server, so a single port serves both. Incoming connections must claim
+	a Tapestry ID during the handshake, and the claim is verified by
+	resolving it through the overlay and challenging the resolved address
+	with the same endpoint-proof ping-back used to bond routing table
+	entries, before any Conn is handed back to Accept's caller.
+*/
+func (tapestry *Tapestry) Listen() (*Listener, error) {
+	localID := tapestry.local.node.Id.String()
+	inner := stream.NewListener(tapestry.streamListener, localID, tapestry.verifyStreamCaller)
+	return &Listener{inner: inner}, nil
+}
+
+/*
+	verifyStreamCaller is the stream.Verifier used by Listen. The connection
+	it's called with is incidental (the caller may be behind a NAT or simply
+	dialing from an ephemeral port that nothing else listens on), so rather
+	than bonding the socket's source address, it resolves claimedID through
+	the overlay via FindRoot and challenges the address the overlay actually
+	believes that ID is reachable at.
+*/
+func (tapestry *Tapestry) verifyStreamCaller(claimedID string, remoteAddr string) bool {
+	id, err := ParseID(claimedID)
+	if err != nil {
+		return false
+	}
+
+	root, err := tapestry.local.FindRootContext(context.Background(), id, DIGITS)
+	if err != nil || root.Id != id {
+		return false
+	}
+
+	return tapestry.bond(root)
+}
+
+/*
+	Dial resolves id to an address via Lookup and opens a stream to it,
+	claiming the local node's own ID in the handshake. The returned net.Conn
+	transparently re-resolves and reconnects if the stream hits io.EOF,
+	since the node responsible for id may have changed address in the
+	meantime.
+*/
+func (tapestry *Tapestry) Dial(id ID) (net.Conn, error) {
+	return tapestry.DialContext(context.Background(), id)
+}
+
+/*
+	DialContext is Dial, plumbed with a context covering the resolution step.
+*/
+func (tapestry *Tapestry) DialContext(ctx context.Context, id ID) (net.Conn, error) {
+	conn := &reconnectingConn{tapestry: tapestry, id: id}
+	if err := conn.reconnect(ctx); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+/*
+	reconnectingConn wraps a stream.Conn dialed to whatever address id last
+	resolved to. A Read that fails without returning data (io.EOF included)
+	or a failed Write triggers a transparent re-lookup and redial, and the
+	operation is retried once on the new stream.
+*/
+type reconnectingConn struct {
+	mutex    sync.Mutex
+	tapestry *Tapestry
+	id       ID
+	inner    *stream.Conn
+}
+
+func (c *reconnectingConn) reconnect(ctx context.Context) error {
+	root, err := c.tapestry.local.FindRootContext(ctx, c.id, DIGITS)
+	if err != nil {
+		return fmt.Errorf("Error resolving %v for dial: %v", c.id, err)
+	}
+
+	localID := c.tapestry.local.node.Id.String()
+	conn, err := stream.Dial("tcp", root.Address, localID)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.inner = conn
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *reconnectingConn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	inner := c.inner
+	c.mutex.Unlock()
+
+	n, err := inner.Read(b)
+	if n == 0 && err != nil {
+		if rerr := c.reconnect(context.Background()); rerr == nil {
+			c.mutex.Lock()
+			inner = c.inner
+			c.mutex.Unlock()
+			return inner.Read(b)
+		}
+	}
+	return n, err
+}
+
+func (c *reconnectingConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	inner := c.inner
+	c.mutex.Unlock()
+
+	n, err := inner.Write(b)
+	if err != nil {
+		if rerr := c.reconnect(context.Background()); rerr == nil {
+			c.mutex.Lock()
+			inner = c.inner
+			c.mutex.Unlock()
+			return inner.Write(b)
+		}
+	}
+	return n, err
+}
+
+func (c *reconnectingConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.inner.Close()
+}
+
+func (c *reconnectingConn) LocalAddr() net.Addr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.inner.LocalAddr()
+}
+
+func (c *reconnectingConn) RemoteAddr() net.Addr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.inner.RemoteAddr()
+}
+
+func (c *reconnectingConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.inner.SetDeadline(t)
+}
+
+func (c *reconnectingConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.inner.SetReadDeadline(t)
+}
+
+func (c *reconnectingConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.inner.SetWriteDeadline(t)
+}
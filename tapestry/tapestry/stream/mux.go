@@ -0,0 +1,113 @@
+package stream
+
+import (
+	"bytes"
+	"io"
+	"net"
+)
+
+// magic prefixes every handshake Dial sends, ahead of the ID frame, so that
+// a Mux sharing a single TCP listener with an unrelated protocol (e.g.
+// net/rpc) can tell a stream connection apart from that protocol's traffic
+// without either side needing to agree on a separate port.
+var magic = []byte("TPSTRM01")
+
+// Mux demultiplexes a single net.Listener into two virtual listeners: one
+// that yields connections whose first bytes are the stream magic, and one
+// that yields everything else unmodified (so an existing protocol server
+// can keep accepting from it as if the Mux wasn't there).
+type Mux struct {
+	raw     net.Listener
+	streams chan net.Conn
+	others  chan net.Conn
+	errs    chan error
+}
+
+// NewMux starts demultiplexing raw in the background. raw should not be
+// accepted from directly once passed to NewMux.
+func NewMux(raw net.Listener) *Mux {
+	m := &Mux{
+		raw:     raw,
+		streams: make(chan net.Conn),
+		others:  make(chan net.Conn),
+		errs:    make(chan error, 1),
+	}
+	go m.run()
+	return m
+}
+
+func (m *Mux) run() {
+	for {
+		conn, err := m.raw.Accept()
+		if err != nil {
+			m.errs <- err
+			close(m.streams)
+			close(m.others)
+			return
+		}
+		go m.classify(conn)
+	}
+}
+
+func (m *Mux) classify(conn net.Conn) {
+	peeked := make([]byte, len(magic))
+	if _, err := io.ReadFull(conn, peeked); err != nil {
+		conn.Close()
+		return
+	}
+
+	if bytes.Equal(peeked, magic) {
+		m.streams <- conn
+		return
+	}
+
+	// Not a stream handshake: hand the connection to the other listener
+	// exactly as accepted, replaying the bytes already peeked off the wire.
+	m.others <- &prefixedConn{Conn: conn, prefix: peeked}
+}
+
+// StreamListener returns the net.Listener side that yields stream.Dial
+// connections.
+func (m *Mux) StreamListener() net.Listener {
+	return &muxSide{mux: m, conns: m.streams}
+}
+
+// OtherListener returns the net.Listener side that yields every connection
+// that wasn't a stream handshake, for an existing protocol server (such as
+// net/rpc) to accept from instead of the raw listener.
+func (m *Mux) OtherListener() net.Listener {
+	return &muxSide{mux: m, conns: m.others}
+}
+
+type muxSide struct {
+	mux   *Mux
+	conns chan net.Conn
+}
+
+func (s *muxSide) Accept() (net.Conn, error) {
+	conn, ok := <-s.conns
+	if !ok {
+		return nil, <-s.mux.errs
+	}
+	return conn, nil
+}
+
+func (s *muxSide) Close() error { return s.mux.raw.Close() }
+func (s *muxSide) Addr() net.Addr { return s.mux.raw.Addr() }
+
+// prefixedConn replays a slice of already-read bytes ahead of further reads
+// from the wrapped conn, so peeking at a connection's first bytes to
+// classify it doesn't lose those bytes for whoever ends up handling it.
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,163 @@
+// Package stream implements a small connection-oriented framing layer used
+// to carry ordinary net.Conn streams over addresses resolved by Tapestry.
+//
+// A Tapestry ID isn't an address, so before a Dial'd connection can be
+// handed to a caller as a plain net.Conn, the two ends exchange a short
+// handshake frame that states the dialer's claimed ID. The listening side is
+// responsible for independently verifying that claim (typically via a
+// ping-back challenge against the overlay) before accepting the stream.
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// maxIDLen bounds the handshake frame so a misbehaving peer can't make the
+// listener allocate an unbounded buffer.
+const maxIDLen = 256
+
+// Verifier is called by a Listener with the ID a dialer claims and the
+// address the connection actually came in on. It should independently
+// confirm that the claim is plausible (e.g. by pinging the claimed ID back
+// through the overlay) before the stream is handed to Accept's caller.
+type Verifier func(claimedID string, remoteAddr string) bool
+
+// Addr reports a Tapestry ID alongside the underlying network address, so
+// that Conn.RemoteAddr() identifies a peer by ID rather than by IP:port.
+type Addr struct {
+	ID         string
+	Underlying net.Addr
+}
+
+func (a Addr) Network() string { return a.Underlying.Network() }
+func (a Addr) String() string  { return fmt.Sprintf("%s@%s", a.ID, a.Underlying.String()) }
+
+// Conn is a net.Conn whose RemoteAddr carries the peer's Tapestry ID instead
+// of just its IP and port.
+type Conn struct {
+	net.Conn
+	remote Addr
+}
+
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+// Listener accepts handshaking connections from an underlying net.Listener,
+// verifies each caller's claimed ID, and yields Conns.
+type Listener struct {
+	underlying net.Listener
+	localID    string
+	verify     Verifier
+}
+
+// NewListener wraps underlying, identifying this side of every accepted
+// connection as localID and verifying the other side's claim with verify.
+func NewListener(underlying net.Listener, localID string, verify Verifier) *Listener {
+	return &Listener{underlying: underlying, localID: localID, verify: verify}
+}
+
+func (l *Listener) Addr() net.Addr { return l.underlying.Addr() }
+
+func (l *Listener) Close() error { return l.underlying.Close() }
+
+// Accept waits for the next handshaking connection, verifies the caller's
+// claimed ID, and returns it as a Conn. Connections that fail the handshake
+// or the verifier are closed and skipped rather than returned as errors, so
+// that a single bad peer can't stall every caller of Accept.
+func (l *Listener) Accept() (*Conn, error) {
+	for {
+		raw, err := l.underlying.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		claimedID, err := readFrame(raw)
+		if err != nil {
+			raw.Close()
+			continue
+		}
+
+		if l.verify != nil && !l.verify(claimedID, raw.RemoteAddr().String()) {
+			raw.Close()
+			continue
+		}
+
+		if err := writeFrame(raw, l.localID); err != nil {
+			raw.Close()
+			continue
+		}
+
+		return &Conn{
+			Conn:   raw,
+			remote: Addr{ID: claimedID, Underlying: raw.RemoteAddr()},
+		}, nil
+	}
+}
+
+// Dial opens a TCP connection to address, claims localID in the handshake,
+// and returns a Conn once the remote side's handshake frame is received.
+//
+// The magic prefix is written ahead of the handshake frame so that a Mux
+// sharing address's port with another protocol can route the connection to
+// the stream side instead of its own.
+func Dial(network, address, localID string) (*Conn, error) {
+	raw, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := raw.Write(magic); err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	if err := writeFrame(raw, localID); err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	remoteID, err := readFrame(raw)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	return &Conn{
+		Conn:   raw,
+		remote: Addr{ID: remoteID, Underlying: raw.RemoteAddr()},
+	}, nil
+}
+
+func writeFrame(w io.Writer, id string) error {
+	if len(id) > maxIDLen {
+		return fmt.Errorf("stream: ID %q exceeds max handshake length", id)
+	}
+
+	header := make([]byte, 2)
+	binary.BigEndian.PutUint16(header, uint16(len(id)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte(id))
+	return err
+}
+
+func readFrame(r io.Reader) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+
+	length := binary.BigEndian.Uint16(header)
+	if length > maxIDLen {
+		return "", fmt.Errorf("stream: handshake frame length %v exceeds max", length)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
@@ -1,10 +1,14 @@
 package tapestry
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
+	"sync"
 	"time"
+
+	"tapestry/tapestry/stream"
 )
 
 /* The Tapestry object provides the API for accessing tapestry.
@@ -27,29 +31,95 @@ type Tapestry struct {
 	local     *TapestryNode      // the local node
 	server    *TapestryRPCServer // receives remote method invocations and calls the corresponding local node methods
 	blobstore *BlobStore         // stores blobs on the local node
+
+	revalidateInterval time.Duration // how often the routing table revalidator checks a random slot
+	revalidateDone     chan struct{} // closed to stop the routing table revalidator
+
+	peers      *bondTable    // endpoint-proof state for peers we've exchanged pings with
+	bondWindow time.Duration // how long a successful pong keeps a peer bonded
+
+	nodeDB            NodeDB        // persistent database of verified peers, used for warm bootstrap
+	nodeDBPath        string        // where the node database is stored
+	nodeDBCleanupDone chan struct{} // closed to stop the node database expiry sweep
+
+	routingNetCap      int // how many routing table entries may share a /24 or /64 bucket
+	routingLevelNetCap int // how many entries from a single bucket are allowed within one routing table level
+	routingNets        *DistinctNetSet
+
+	routingLevelNetsMutex sync.Mutex
+	routingLevelNets      map[int]*DistinctNetSet // per-routing-table-level subnet diversity, keyed by level
+
+	replacements *replacementCache // candidates waiting to fill a slot if its occupant goes dead
+
+	streamListener net.Listener // the demuxed side of the shared port carrying Listen()'s streams
 }
 
 /*
-	Public API: Start a tapestry node on the specified port.
+	Public API: Start a tapestry node on the specified port, using the
+	package defaults for revalidation interval, bond window, node database
+	path, and subnet diversity caps.
 
 	Optionally, specify the address of an existing node in the tapestry mesh to connect to, otherwise set to ""
 */
 func Start(port int, connectTo string) (*Tapestry, error) {
-	return start(RandomID(), port, connectTo)
+	return StartWithConfig(port, connectTo, Config{})
+}
+
+/*
+	Public API: Start a tapestry node on the specified port, as Start does,
+	but with config overriding the package defaults. Any field left at its
+	zero value in config still falls back to the default.
+*/
+func StartWithConfig(port int, connectTo string, config Config) (*Tapestry, error) {
+	return start(RandomID(), port, connectTo, config)
 }
 
 /*
 	Private method, useful for testing: start a node with the specified ID rather than a random ID
 */
-func start(id ID, port int, connectTo string) (tapestry *Tapestry, err error) {
+func start(id ID, port int, connectTo string, config Config) (tapestry *Tapestry, err error) {
+	config = config.withDefaults()
+
 	// Create the tapestry object
 	tapestry = new(Tapestry)
 
 	// Create the blob store
 	tapestry.blobstore = NewBlobStore()
 
-	// Create the RPC server
-	tapestry.server, err = newTapestryRPCServer(port, tapestry)
+	// Create the endpoint-proof bond table
+	tapestry.peers = newBondTable()
+	tapestry.bondWindow = config.BondWindow
+
+	// Open the persistent node database
+	tapestry.nodeDBPath = config.NodeDBPath
+	if tapestry.nodeDBPath == "" {
+		tapestry.nodeDBPath = defaultNodeDBPath(id)
+	}
+	tapestry.nodeDB, err = NewJSONNodeDB(tapestry.nodeDBPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cap how many routing table entries may come from a single /24 or /64
+	tapestry.routingNetCap = config.RoutingNetCap
+	tapestry.routingLevelNetCap = config.RoutingLevelNetCap
+	tapestry.routingNets = NewDistinctNetSet(tapestry.routingNetCap)
+	tapestry.routingLevelNets = make(map[int]*DistinctNetSet)
+
+	// Candidates waiting to fill a slot if its occupant goes dead
+	tapestry.replacements = newReplacementCache()
+
+	// Open the shared TCP listener and demux RPC traffic from user streams on
+	// it, so Listen() doesn't need a port of its own
+	rawListener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	mux := stream.NewMux(rawListener)
+	tapestry.streamListener = mux.StreamListener()
+
+	// Create the RPC server over the demuxed non-stream side of the listener
+	tapestry.server, err = newTapestryRPCServerFromListener(mux.OtherListener(), tapestry)
 	if err != nil {
 		return nil, err
 	}
@@ -72,6 +142,22 @@ func start(id ID, port int, connectTo string) (tapestry *Tapestry, err error) {
 	// Create the local node
 	tapestry.local = newTapestryNode(Node{id, address}, tapestry)
 
+	// Start the background routing table revalidator
+	tapestry.revalidateInterval = config.RevalidateInterval
+	tapestry.revalidateDone = make(chan struct{})
+	tapestry.startRevalidator()
+
+	// Start the background node database expiry sweep
+	tapestry.nodeDBCleanupDone = make(chan struct{})
+	tapestry.startNodeDBCleanup()
+
+	// If no address was given to connect to, fall back to a seed from the node database
+	if connectTo == "" {
+		if seeds := tapestry.Seeds(); len(seeds) > 0 {
+			connectTo = seeds[0].Address
+		}
+	}
+
 	// If specified, connect to the provided address
 	if connectTo != "" {
 		// Get the node we're joining
@@ -92,7 +178,23 @@ func start(id ID, port int, connectTo string) (tapestry *Tapestry, err error) {
 	Leave the tapestry.  In the current implementation, this method may only be called once
 */
 func (tapestry *Tapestry) Leave() {
-	tapestry.local.Leave()
+	tapestry.LeaveContext(context.Background())
+}
+
+/*
+	LeaveContext is Leave, plumbed with a context so that the RPCs involved in
+	gracefully handing off routing state and advertised objects to neighbours
+	abort as soon as ctx is canceled or its deadline passes.
+*/
+func (tapestry *Tapestry) LeaveContext(ctx context.Context) {
+	ctx = withRequestID(ctx)
+	reqID, _ := RequestIDFromContext(ctx)
+	Debug.Printf("[%v] Leaving tapestry\n", reqID)
+
+	close(tapestry.revalidateDone)
+	close(tapestry.nodeDBCleanupDone)
+	tapestry.nodeDB.Close()
+	tapestry.local.LeaveContext(ctx)
 	tapestry.server.listener.Close()
 }
 
@@ -100,6 +202,9 @@ func (tapestry *Tapestry) Leave() {
    Kill this node without gracefully leaving the tapestry
 */
 func (tapestry *Tapestry) Kill() {
+	close(tapestry.revalidateDone)
+	close(tapestry.nodeDBCleanupDone)
+	tapestry.nodeDB.Close()
 	tapestry.server.listener.Close()
 }
 
@@ -107,7 +212,19 @@ func (tapestry *Tapestry) Kill() {
 	Store a blob on the local node and publish the key to the tapestry
 */
 func (tapestry *Tapestry) Store(key string, value []byte) error {
-	done, err := tapestry.local.Publish(key)
+	return tapestry.StoreContext(context.Background(), key, value)
+}
+
+/*
+	StoreContext is Store, plumbed with a context so that a caller can bound
+	or cancel the underlying Publish, which may hop across several nodes.
+*/
+func (tapestry *Tapestry) StoreContext(ctx context.Context, key string, value []byte) error {
+	ctx = withRequestID(ctx)
+	reqID, _ := RequestIDFromContext(ctx)
+	Debug.Printf("[%v] Storing key %v\n", reqID, key)
+
+	done, err := tapestry.local.PublishContext(ctx, key)
 	if err != nil {
 		return err
 	}
@@ -119,15 +236,36 @@ func (tapestry *Tapestry) Store(key string, value []byte) error {
 	Lookup a key in the tapestry and return its root node
 */
 func (tapestry *Tapestry) Lookup(key string) ([]Node, error) {
-	return tapestry.local.Lookup(key)
+	return tapestry.LookupContext(context.Background(), key)
+}
+
+/*
+	LookupContext is Lookup, plumbed with a context so that a lookup spanning
+	many hops can be aborted as soon as ctx is canceled or times out.
+*/
+func (tapestry *Tapestry) LookupContext(ctx context.Context, key string) ([]Node, error) {
+	ctx = withRequestID(ctx)
+	return tapestry.local.LookupContext(ctx, key)
 }
 
 /*
 	Lookup a key in the tapestry then fetch the corresponding blob from the remote blob store
 */
 func (tapestry *Tapestry) Get(key string) ([]byte, error) {
+	return tapestry.GetContext(context.Background(), key)
+}
+
+/*
+	GetContext is Get, plumbed with a context covering both the lookup and
+	the subsequent replica fetch, so a slow Get can be traced end-to-end via
+	the request ID carried on ctx and aborted on cancellation.
+*/
+func (tapestry *Tapestry) GetContext(ctx context.Context, key string) ([]byte, error) {
+	ctx = withRequestID(ctx)
+	reqID, _ := RequestIDFromContext(ctx)
+
 	// Lookup the key
-	replicas, err := tapestry.Lookup(key)
+	replicas, err := tapestry.LookupContext(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -138,7 +276,14 @@ func (tapestry *Tapestry) Get(key string) ([]byte, error) {
 	// Contact replicas
 	var errs []error
 	for _, replica := range replicas {
-		blob, err := FetchRemoteBlob(replica, key)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		Debug.Printf("[%v] Fetching %v from replica %v\n", reqID, key, replica)
+		blob, err := fetchRemoteBlobContext(ctx, replica, key)
 		if err != nil {
 			errs = append(errs, err)
 		}
@@ -154,6 +299,19 @@ func (tapestry *Tapestry) Get(key string) ([]byte, error) {
 	Remove the blob from the local blob store and stop advertising
 */
 func (tapestry *Tapestry) Remove(key string) bool {
+	return tapestry.RemoveContext(context.Background(), key)
+}
+
+/*
+	RemoveContext is Remove, plumbed with a context for consistency with the
+	rest of the public API. Removal is purely local, so ctx is only used for
+	its request ID.
+*/
+func (tapestry *Tapestry) RemoveContext(ctx context.Context, key string) bool {
+	ctx = withRequestID(ctx)
+	reqID, _ := RequestIDFromContext(ctx)
+	Debug.Printf("[%v] Removing key %v\n", reqID, key)
+
 	return tapestry.blobstore.Delete(key)
 }
 